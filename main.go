@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -17,17 +25,19 @@ func main() {
 		log: log.New(os.Stdout, "helps: ", log.Llongfile|log.LstdFlags|log.LUTC),
 	}
 
-	routes := map[string]http.HandlerFunc{
+	routes := map[string]Handler{
 		"/":        a.defaultHandler,
 		"/healthz": a.healthzHandler,
 		"/example": a.exampleHandler,
 	}
 	for p, h := range routes {
-		a.mux.HandleFunc(p, h)
+		a.mux.HandleFunc(p, a.context(a.recovery(a.handle(h))))
 	}
 
+	handler := a.accessLog()(a.mux)
+
 	a.log.Println("starting server on :9090")
-	a.log.Fatal(http.ListenAndServe(":9090", a.mux))
+	a.log.Fatal(http.ListenAndServe(":9090", handler))
 }
 
 var (
@@ -39,42 +49,249 @@ type api struct {
 	log *log.Logger
 }
 
-func (a *api) defaultHandler(w http.ResponseWriter, r *http.Request) {}
-func (a *api) healthzHandler(w http.ResponseWriter, r *http.Request) {}
+// Handler is the signature for endpoint handlers. Instead of writing errors
+// to the client directly, a Handler returns them, letting a.handle report
+// them consistently.
+type Handler func(http.ResponseWriter, *http.Request) *httpError
+
+// handle adapts a Handler into an http.HandlerFunc, reporting any returned
+// error via a.error.
+func (a *api) handle(h Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			a.error(w, r, err)
+		}
+	}
+}
+
+// recovery wraps an http.HandlerFunc with panic recovery, converting any
+// panic into a 500 response and logging the stack trace so it can be
+// diagnosed alongside the errID reported to the client.
+func (a *api) recovery(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				loggerFrom(r.Context(), a.log).Printf("panic=%v\n%s", rec, debug.Stack())
+				a.error(w, r, error500(fmt.Errorf("panic: %v", rec)))
+			}
+		}()
+		h(w, r)
+	}
+}
+
+type ctxKey int
+
+const (
+	ctxKeyRequestLogger ctxKey = iota
+	ctxKeyErrID
+)
+
+// WithRequestLogger returns a context carrying l as the request-scoped
+// logger, retrievable via RequestLogger.
+func WithRequestLogger(ctx context.Context, l *log.Logger) context.Context {
+	return context.WithValue(ctx, ctxKeyRequestLogger, l)
+}
+
+// RequestLogger returns the request-scoped logger stored in ctx by
+// WithRequestLogger, or nil if none was stored.
+func RequestLogger(ctx context.Context) *log.Logger {
+	l, _ := ctx.Value(ctxKeyRequestLogger).(*log.Logger)
+	return l
+}
+
+// loggerFrom returns the request-scoped logger from ctx, falling back to l
+// if a.context hasn't run (or hasn't set one) for this request.
+func loggerFrom(ctx context.Context, l *log.Logger) *log.Logger {
+	if rl := RequestLogger(ctx); rl != nil {
+		return rl
+	}
+	return l
+}
+
+// WithErrID returns a context carrying id as the request's errID,
+// retrievable via ErrID.
+func WithErrID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyErrID, id)
+}
+
+// ErrID returns the errID stored in ctx by WithErrID, or "" if none was
+// stored.
+func ErrID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyErrID).(string)
+	return id
+}
+
+// context generates a per-request errID, injects it and a child logger into
+// the request context, and sets X-Errid on the response before calling h, so
+// every log line and the eventual error response can be correlated.
+func (a *api) context(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, genErr := genUUID()
+		if genErr != nil {
+			a.log.Printf("genErr=%v, msg=%q", genErr, "error while generating request errID")
+			// continue since we can still serve the request with an empty errID
+		}
+		w.Header().Set("X-Errid", id)
+
+		ctx := WithErrID(r.Context(), id)
+		ctx = WithRequestLogger(ctx, log.New(a.log.Writer(), fmt.Sprintf("%serrID=%q ", a.log.Prefix(), id), a.log.Flags()))
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// Middleware composes around an http.Handler, for cross-cutting concerns
+// that apply to every request regardless of route, such as access logging,
+// auth, or rate limiting.
+type Middleware func(http.Handler) http.Handler
+
+// responseWriter shims http.ResponseWriter to capture the status code and
+// byte count of the response for access logging.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// accessLog returns a Middleware that logs one structured line per request
+// with the method, path, remote address, status, bytes written, duration,
+// user agent, and the errID that a.context set on the X-Errid response
+// header.
+func (a *api) accessLog() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r)
+			a.log.Printf(
+				"method=%q, path=%q, remote=%q, status=%d, bytes=%d, duration_ms=%d, user_agent=%q, errID=%q",
+				r.Method, r.URL.Path, r.RemoteAddr, rw.status, rw.bytes,
+				time.Since(start).Milliseconds(), r.UserAgent(), rw.Header().Get("X-Errid"),
+			)
+		})
+	}
+}
+
+func (a *api) defaultHandler(w http.ResponseWriter, r *http.Request) *httpError { return nil }
+func (a *api) healthzHandler(w http.ResponseWriter, r *http.Request) *httpError { return nil }
 
-func (a *api) exampleHandler(w http.ResponseWriter, r *http.Request) {
-	a.error(w, error500(fmt.Errorf("exampleHandler: %v", errBroken)))
+func (a *api) exampleHandler(w http.ResponseWriter, r *http.Request) *httpError {
+	return error500(fmt.Errorf("exampleHandler: %v", errBroken))
 }
 
 /*
 Examples:
-	a.error(w, error500(err))
+	return error500(err)
 
-	a.error(w, error400(err, "bad json"))
+	return error400(err, "bad json")
 
-	a.error(w, error400(err, "id empty"))
+	return error400(err, "id empty")
 
-	a.error(w, error404(err, "entry %q not found", entryid))
+	return error404(err, "entry %q not found", entryid)
+
+	return JSONResult(w, r, result)
 */
 
 // error logs an error to the client and the server logs, linking the external
-// facing error and the internal error via a random unique ID. It relies on
-// httpError's contract for preventing external visibility of internal error
-// details.
-func (a *api) error(w http.ResponseWriter, err *httpError) {
-	id, genErr := genUUID()
-	if genErr != nil {
-		a.log.Printf("genErr=%v, msg=%q", genErr, "error while reporting API error")
-		// continue since we can still report the error with an empty errID
+// facing error and the internal error via the request's errID (see
+// WithErrID). It relies on httpError's contract for preventing external
+// visibility of internal error details. The response body is negotiated
+// against the request's Accept header: JSON by default, with plain text and
+// HTML alternatives for clients that prefer them.
+func (a *api) error(w http.ResponseWriter, r *http.Request, err *httpError) {
+	id := ErrID(r.Context())
+	err.errID = id
+	logger := loggerFrom(r.Context(), a.log)
+	if err.code >= 500 {
+		logger.Printf("stack=%v", err.StackTrace())
 	}
-	w.Header().Set("X-Errid", id)
-	w.WriteHeader(err.code)
-	encodeErr := json.NewEncoder(w).Encode(err)
-	if encodeErr != nil {
-		a.log.Printf("errID=%q, err=%v, encodeErr=%v, msg=%v", id, err, encodeErr, "error while reporting API error")
-		return
+
+	switch negotiate(r, "application/json", "text/plain", "text/html") {
+	case "text/plain":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(err.code)
+		fmt.Fprintf(w, "errID: %s\ncode: %s\nerror: %s\n", id, err.errCode, fmt.Sprintf(err.msg, err.args...))
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(err.code)
+		fmt.Fprintf(w, "<!DOCTYPE html><title>%d %s</title><h1>%s</h1><p>%s</p><p>request: %s</p>",
+			err.code, html.EscapeString(http.StatusText(err.code)), html.EscapeString(http.StatusText(err.code)),
+			html.EscapeString(fmt.Sprintf(err.msg, err.args...)), html.EscapeString(id))
+	default:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(err.code)
+		if encodeErr := json.NewEncoder(w).Encode(err); encodeErr != nil {
+			logger.Printf("err=%v, encodeErr=%v, msg=%v", err, encodeErr, "error while reporting API error")
+			return
+		}
 	}
-	a.log.Printf("errID=%q, err=%v", id, err)
+	logger.Printf("err=%v", err)
+}
+
+// negotiate picks the offer that best matches the request's Accept header,
+// honouring q-values, and falls back to offers[0] if the header is absent or
+// matches none of the offers.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	type candidate struct {
+		mime string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mime := strings.TrimSpace(fields[0])
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if v, ok := strings.CutPrefix(f, "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q <= 0 {
+			// q=0 means "not acceptable" per RFC 7231 §5.3.1.
+			continue
+		}
+		candidates = append(candidates, candidate{mime, q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		for _, offer := range offers {
+			if c.mime == offer || c.mime == "*/*" {
+				return offer
+			}
+		}
+	}
+	return offers[0]
+}
+
+// JSONResult writes v as the JSON response body for a successful request. It
+// centralizes the Content-Type and encoding logic so handlers have a success
+// path as simple as the error path; the X-Errid header is already set by
+// a.context for both.
+func JSONResult(w http.ResponseWriter, r *http.Request, v interface{}) *httpError {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return error500(fmt.Errorf("JSONResult: %v", err))
+	}
+	return nil
 }
 
 // genUUID generates a random hex string in the UUID format:
@@ -102,21 +319,72 @@ func genUUID() (string, error) {
 
 // httpError is an error with dual internal / external use.
 // It fmt's to the underlying error for recording internal errors.
-// It json.Marshal's to the msg field with optional args in fmt format for
-// external use.
+// It json.Marshal's to a stable envelope of the code, msg and details for
+// external use. errID is stamped on by a.error from the request context and
+// is never part of the envelope's machine-readable code.
 type httpError struct {
 	error
-	code int
-	msg  string
-	args []interface{}
+	code    int
+	errCode string
+	msg     string
+	args    []interface{}
+	details map[string]interface{}
+	errID   string
+	stack   []uintptr
 }
 
 func newHTTPError(err error, code int, msg string, args ...interface{}) *httpError {
 	return &httpError{
-		error: err,
-		code:  code,
-		msg:   msg,
-		args:  args,
+		error:   err,
+		code:    code,
+		errCode: defaultCode(code),
+		msg:     msg,
+		args:    args,
+		stack:   callers(),
+	}
+}
+
+// newCodedError builds an httpError for the registry of predefined errors,
+// where ecode identifies the error independently of msg.
+func newCodedError(code int, ecode, msg string) *httpError {
+	return &httpError{
+		error:   errors.New(msg),
+		code:    code,
+		errCode: ecode,
+		msg:     msg,
+		stack:   callers(),
+	}
+}
+
+// callers captures the call stack, skipping the frames for runtime.Callers,
+// callers itself, and its immediate caller (the httpError constructor), so
+// the first recorded frame is where the constructor was invoked from.
+func callers() []uintptr {
+	var pcs [32]uintptr
+	n := runtime.Callers(3, pcs[:])
+	return pcs[:n]
+}
+
+// defaultCode maps an HTTP status to the machine-readable code used when a
+// more specific one isn't given, e.g. by the error500/400/404 helpers.
+func defaultCode(status int) string {
+	switch status {
+	case 400:
+		return "args_invalid"
+	case 401:
+		return "auth_failed"
+	case 403:
+		return "no_permission"
+	case 404:
+		return "not_found"
+	case 409:
+		return "conflict"
+	case 429:
+		return "rate_limited"
+	case 503:
+		return "unavailable"
+	default:
+		return "internal"
 	}
 }
 
@@ -132,11 +400,62 @@ func error404(err error, msg string, args ...interface{}) *httpError {
 	return newHTTPError(err, 404, msg, args...)
 }
 
+// WithErr attaches the underlying internal error for logging, without
+// changing the client-facing code or message.
+func (err *httpError) WithErr(e error) *httpError {
+	err.error = e
+	return err
+}
+
+// WithDetails attaches machine-readable details to the error response.
+func (err *httpError) WithDetails(details map[string]interface{}) *httpError {
+	err.details = details
+	return err
+}
+
+// Registry of predefined errors for handlers to return instead of building
+// ad-hoc errors with error400/404/500.
+func ErrArgsInvalid() *httpError  { return newCodedError(400, "args_invalid", "invalid arguments") }
+func ErrAuthFailed() *httpError   { return newCodedError(401, "auth_failed", "authentication failed") }
+func ErrAuthExpired() *httpError  { return newCodedError(401, "auth_expired", "authentication expired") }
+func ErrNoPermission() *httpError { return newCodedError(403, "no_permission", "no permission") }
+func ErrNotFound() *httpError     { return newCodedError(404, "not_found", "not found") }
+func ErrConflict() *httpError     { return newCodedError(409, "conflict", "conflict") }
+func ErrRateLimited() *httpError  { return newCodedError(429, "rate_limited", "rate limited") }
+func ErrUnavailable() *httpError  { return newCodedError(503, "unavailable", "service unavailable") }
+
+// StackTrace resolves the call stack captured at construction into
+// "file:line function" strings, innermost frame first (the constructor's
+// caller, unwinding outward through main/runtime.goexit). It is for internal
+// logging only and is never included in MarshalJSON's output.
+func (err *httpError) StackTrace() []string {
+	frames := runtime.CallersFrames(err.stack)
+	var trace []string
+	for {
+		frame, more := frames.Next()
+		trace = append(trace, fmt.Sprintf("%s:%d %s", frame.File, frame.Line, frame.Function))
+		if !more {
+			break
+		}
+	}
+	return trace
+}
+
 func (err *httpError) MarshalJSON() ([]byte, error) {
 	msg := struct {
-		Err string `json:"err"`
+		Status  int                    `json:"status"`
+		Code    string                 `json:"code"`
+		Error   string                 `json:"error"`
+		Message string                 `json:"message"`
+		Request string                 `json:"request"`
+		Details map[string]interface{} `json:"details,omitempty"`
 	}{
-		Err: fmt.Sprintf(err.msg, err.args...),
+		Status:  err.code,
+		Code:    err.errCode,
+		Error:   http.StatusText(err.code),
+		Message: fmt.Sprintf(err.msg, err.args...),
+		Request: err.errID,
+		Details: err.details,
 	}
 	return json.Marshal(msg)
 }